@@ -22,7 +22,7 @@ import (
 	"k8s.io/kops/pkg/apis/nodeup"
 	"k8s.io/kops/pkg/model/resources"
 	"k8s.io/kops/upup/pkg/fi"
-	"os"
+	"net/url"
 	"text/template"
 	"strconv"
 )
@@ -32,6 +32,9 @@ type BootstrapScript struct {
 	NodeUpSource        string
 	NodeUpSourceHash    string
 	NodeUpConfigBuilder func(ig *kops.InstanceGroup) (*nodeup.NodeUpConfig, error)
+	SSHTunnel           *kops.SSHTunnelSpec
+	SecretStore         SecretStore
+	StateStore          string
 }
 
 func (b *BootstrapScript) ResourceNodeUp(ig *kops.InstanceGroup, ps *kops.EgressProxiesSpec) (*fi.ResourceHolder, error) {
@@ -47,6 +50,78 @@ func (b *BootstrapScript) ResourceNodeUp(ig *kops.InstanceGroup, ps *kops.Egress
 		"NodeUpSourceHash": func() string {
 			return b.NodeUpSourceHash
 		},
+
+		// NodeUpProxy emits the curl/wget invocation nodeup should use to fetch
+		// NodeUpSource. When an EgressProxy is configured, the download is routed
+		// through it: curl's --proxy dials the proxy and, for an https:// source,
+		// transparently issues an HTTP CONNECT to tunnel the TLS connection through;
+		// wget is told the same via -e use_proxy=yes/https_proxy.
+		"NodeUpProxy": func() string {
+			return nodeUpFetchCommand(b.NodeUpSource, ps)
+		},
+		// SSHTunnelEnv installs the master's SSH public key into this node's
+		// authorized_keys, so that an apiserver with no direct route to the
+		// node (no ELB/NAT path) can reach kubelet/pod endpoints by dialing
+		// the node's own sshd directly with that key instead. There is no
+		// kubelet-side component to this: apiserver's --ssh-user/--ssh-keyfile
+		// flags (see SSHProxyBuilder) do the dialing, so the node only needs
+		// sshd configured to accept the key.
+		"SSHTunnelEnv": func() (string, error) {
+			if b.SSHTunnel == nil || !b.SSHTunnel.Enabled {
+				return "", nil
+			}
+
+			authorizedKey, err := AuthorizedKeyForSSHTunnel(b.SSHTunnel)
+			if err != nil {
+				return "", err
+			}
+
+			user := b.SSHTunnel.User
+			if user == "" {
+				user = "sshproxy"
+			}
+
+			return fmt.Sprintf(
+				"id -u %s >/dev/null 2>&1 || useradd -m -s /bin/false %s\n"+
+					"install -d -m 0700 -o %s ~%s/.ssh\n"+
+					"cat > ~%s/.ssh/authorized_keys << __SSH_TUNNEL_AUTHORIZED_KEYS\n"+
+					"%s\n"+
+					"__SSH_TUNNEL_AUTHORIZED_KEYS\n"+
+					"chown %s ~%s/.ssh/authorized_keys\n"+
+					"chmod 0600 ~%s/.ssh/authorized_keys\n"+
+					"echo 'GatewayPorts no' >> /etc/ssh/sshd_config\n"+
+					"echo 'ClientAliveInterval 30' >> /etc/ssh/sshd_config\n"+
+					"systemctl reload sshd\n",
+				user, user, user, user, user, authorizedKey, user, user, user), nil
+		},
+
+		// SSHProxyMasterEnv materializes the SSH tunnel private key on the
+		// master and wires up apiserver's --ssh-user/--ssh-keyfile flags via
+		// SSHProxyBuilder, so apiserver can dial this key into nodes' sshd.
+		// It is a no-op for non-master instance groups.
+		"SSHProxyMasterEnv": func() (string, error) {
+			if ig.Spec.Role != kops.InstanceGroupRoleMaster {
+				return "", nil
+			}
+
+			builder := &SSHProxyBuilder{SSHTunnel: b.SSHTunnel, SecretStore: b.SecretStore}
+
+			env, err := builder.MaterializeEnv()
+			if err != nil || env == "" {
+				return env, err
+			}
+
+			flags, err := builder.APIServerFlags()
+			if err != nil {
+				return "", err
+			}
+
+			for _, name := range []string{"ssh-user", "ssh-keyfile"} {
+				env += fmt.Sprintf("echo '--%s=%s' >> /etc/sysconfig/kube-apiserver.flags\n", name, flags[name])
+			}
+			return env, nil
+		},
+
 		"KubeEnv": func() (string, error) {
 			config, err := b.NodeUpConfigBuilder(ig)
 			if err != nil {
@@ -61,43 +136,21 @@ func (b *BootstrapScript) ResourceNodeUp(ig *kops.InstanceGroup, ps *kops.Egress
 			return string(data), nil
 		},
 
-		// Pass in extra environment variables for user-defined S3 service
-		"S3Env": func() string {
-			if os.Getenv("S3_ENDPOINT") != "" {
-				return fmt.Sprintf("export S3_ENDPOINT=%s\nexport S3_REGION=%s\nexport S3_ACCESS_KEY_ID=%s\nexport S3_SECRET_ACCESS_KEY=%s\n",
-					os.Getenv("S3_ENDPOINT"),
-					os.Getenv("S3_REGION"),
-					os.Getenv("S3_ACCESS_KEY_ID"),
-					os.Getenv("S3_SECRET_ACCESS_KEY"))
-			}
-			return ""
+		// Pass in extra environment variables and credentials for whichever
+		// object store backs the kops state store, honoring a per-instance-group
+		// ObjectStore override.
+		"ResourceStoreEnv": func() (string, error) {
+			return ResourceStoreEnv(b.StateStore, ig.Spec.ObjectStore)
+		},
+		// S3Env is a compatibility alias for ResourceStoreEnv, kept so that
+		// nodeup templates built against the older S3-only function name keep
+		// rendering without a matching template change.
+		"S3Env": func() (string, error) {
+			return ResourceStoreEnv(b.StateStore, ig.Spec.ObjectStore)
 		},
 
 		"ProxyEnv": func() string {
-			scriptSnippet := ""
-
-			if ps != nil && ps.HTTPProxy.Host != "" {
-				httpProxyUrl := "http://"
-				if ps.HTTPProxy.User != "" {
-
-					httpProxyUrl += ps.HTTPProxy.User
-					if ps.HTTPProxy.Password != "" {
-						httpProxyUrl += "@" + ps.HTTPProxy.Password
-					}
-				}
-				httpProxyUrl += ps.HTTPProxy.Host + ":" + strconv.Itoa(ps.HTTPProxy.Port)
-				scriptSnippet =
-					"export HTTP_PROXY=" + httpProxyUrl + "\n" +
-						"export NO_PROXY=" + ps.ProxyExcludes + "\n" +
-						"cat >> /etc/default/docker << __ETC_DEFAULT_DOCKER\n" +
-						"export HTTP_PROXY=${HTTP_PROXY}\n" +
-						"export NO_PROXY=${NO_PROXY}\n" +
-						"__ETC_DEFAULT_DOCKER\n" +
-						"echo DefaultEnvironment=http_proxy=${HTTP_PROXY} https_proxy=${HTTP_PROXY} ftp_proxy=${HTTP_PROXY} no_proxy=${NO_PROXY} >> /etc/systemd/system.conf\n" +
-						"systemctl daemon-reexec\n" +
-						"echo 'Acquire::http::Proxy \"${HTTP_PROXY}\";' > /etc/apt/apt.conf.d/30proxy\n\n"
-			}
-			return scriptSnippet
+			return proxyEnvScript(ps)
 		},
 	}
 
@@ -107,3 +160,103 @@ func (b *BootstrapScript) ResourceNodeUp(ig *kops.InstanceGroup, ps *kops.Egress
 	}
 	return fi.WrapResource(templateResource), nil
 }
+
+// buildProxyURL assembles an RFC-3986-valid proxy URL from an HTTPProxySpec,
+// percent-encoding any user/password via the net/url userinfo rules (not
+// query-escaping, which would turn a space into "+" instead of "%20") so
+// that special characters (":", "@", " ", etc) don't corrupt the resulting
+// authority section.
+func buildProxyURL(p kops.HTTPProxySpec) string {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   p.Host + ":" + strconv.Itoa(p.Port),
+	}
+	if p.User != "" {
+		if p.Password != "" {
+			u.User = url.UserPassword(p.User, p.Password)
+		} else {
+			u.User = url.User(p.User)
+		}
+	}
+	return u.String()
+}
+
+// proxySpecForSource picks which of ps's proxies should front a request for
+// source: the proxy spec matching source's own scheme if it's configured,
+// falling back to whichever of HTTPProxy/HTTPSProxy is set. Returns nil if
+// ps is nil or neither proxy is configured.
+func proxySpecForSource(source string, ps *kops.EgressProxiesSpec) *kops.HTTPProxySpec {
+	if ps == nil {
+		return nil
+	}
+
+	if u, err := url.Parse(source); err == nil && u.Scheme == "https" && ps.HTTPSProxy.Host != "" {
+		return &ps.HTTPSProxy
+	}
+
+	switch {
+	case ps.HTTPProxy.Host != "":
+		return &ps.HTTPProxy
+	case ps.HTTPSProxy.Host != "":
+		return &ps.HTTPSProxy
+	default:
+		return nil
+	}
+}
+
+// nodeUpFetchCommand builds the curl/wget invocation nodeup should use to
+// fetch nodeUpSource, routing the download through whichever of ps's
+// HTTPProxy/HTTPSProxy fronts nodeUpSource's scheme, if either is configured.
+func nodeUpFetchCommand(nodeUpSource string, ps *kops.EgressProxiesSpec) string {
+	proxy := proxySpecForSource(nodeUpSource, ps)
+	if proxy == nil {
+		return fmt.Sprintf("curl -f --ipv4 -s --connect-timeout 20 -o nodeup %s", nodeUpSource)
+	}
+
+	proxyUrl := buildProxyURL(*proxy)
+
+	return fmt.Sprintf(
+		"curl -f --ipv4 -s --connect-timeout 20 --proxy %s -o nodeup %s || "+
+			"(export http_proxy=%s https_proxy=%s && wget -e use_proxy=yes -e http_proxy=${http_proxy} -e https_proxy=${https_proxy} -O nodeup %s)",
+		proxyUrl, nodeUpSource, proxyUrl, proxyUrl, nodeUpSource)
+}
+
+// proxyEnvScript emits the shell snippet that exports HTTP_PROXY/HTTPS_PROXY
+// (and configures docker/apt/systemd to use them) for ps's egress proxies.
+// Either HTTPProxy or HTTPSProxy alone is enough to emit a config: the unset
+// one falls back to whichever is configured, matching curl/wget's own
+// behavior of using HTTPS_PROXY for HTTPS_PROXY-less HTTP_PROXY setups.
+func proxyEnvScript(ps *kops.EgressProxiesSpec) string {
+	if ps == nil || (ps.HTTPProxy.Host == "" && ps.HTTPSProxy.Host == "") {
+		return ""
+	}
+
+	var httpProxyUrl, httpsProxyUrl string
+	if ps.HTTPProxy.Host != "" {
+		httpProxyUrl = buildProxyURL(ps.HTTPProxy)
+	}
+	if ps.HTTPSProxy.Host != "" {
+		httpsProxyUrl = buildProxyURL(ps.HTTPSProxy)
+	} else {
+		httpsProxyUrl = httpProxyUrl
+	}
+	if httpProxyUrl == "" {
+		httpProxyUrl = httpsProxyUrl
+	}
+
+	return "export HTTP_PROXY=" + httpProxyUrl + "\n" +
+		"export HTTPS_PROXY=" + httpsProxyUrl + "\n" +
+		"export NO_PROXY=" + ps.ProxyExcludes + "\n" +
+		"export http_proxy=${HTTP_PROXY}\n" +
+		"export https_proxy=${HTTPS_PROXY}\n" +
+		"export no_proxy=${NO_PROXY}\n" +
+		"cat >> /etc/default/docker << __ETC_DEFAULT_DOCKER\n" +
+		"export HTTP_PROXY=${HTTP_PROXY}\n" +
+		"export HTTPS_PROXY=${HTTPS_PROXY}\n" +
+		"export NO_PROXY=${NO_PROXY}\n" +
+		"__ETC_DEFAULT_DOCKER\n" +
+		"echo DefaultEnvironment=http_proxy=${HTTP_PROXY} https_proxy=${HTTPS_PROXY} ftp_proxy=${HTTP_PROXY} no_proxy=${NO_PROXY} >> /etc/systemd/system.conf\n" +
+		"systemctl daemon-reexec\n" +
+		"echo 'Acquire::http::Proxy \"${HTTP_PROXY}\";' > /etc/apt/apt.conf.d/30proxy\n" +
+		"echo 'Acquire::https::Proxy \"${HTTPS_PROXY}\";' >> /etc/apt/apt.conf.d/30proxy\n\n"
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package model
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"k8s.io/kops/pkg/apis/kops"
+)
+
+// ResourceStoreBackend identifies which object-store API a kops state store
+// URL scheme (or an instance group's ObjectStore override) maps to.
+type ResourceStoreBackend string
+
+const (
+	// ResourceStoreBackendNone means the state store isn't backed by one of
+	// the object stores below (e.g. file:// or memfs://, used for local
+	// development) and so needs no credential environment at all.
+	ResourceStoreBackendNone         ResourceStoreBackend = ""
+	ResourceStoreBackendS3           ResourceStoreBackend = "s3"
+	ResourceStoreBackendGCS          ResourceStoreBackend = "gcs"
+	ResourceStoreBackendSwift        ResourceStoreBackend = "swift"
+	ResourceStoreBackendS3Compatible ResourceStoreBackend = "s3compatible"
+)
+
+// resourceStoreBackendForScheme maps a kops state store URL scheme to the
+// ResourceStoreBackend that serves it. Schemes with no corresponding object
+// store (file://, memfs://, and any other VFS kops supports) map to
+// ResourceStoreBackendNone rather than erroring, matching the original
+// S3Env behavior of silently doing nothing when there's no object store to
+// configure credentials for.
+func resourceStoreBackendForScheme(scheme string) ResourceStoreBackend {
+	switch scheme {
+	case "s3":
+		return ResourceStoreBackendS3
+	case "gs":
+		return ResourceStoreBackendGCS
+	case "swift":
+		return ResourceStoreBackendSwift
+	case "oss":
+		return ResourceStoreBackendS3Compatible
+	default:
+		return ResourceStoreBackendNone
+	}
+}
+
+// resolveResourceStoreBackend picks the backend for stateStore, unless
+// override supplies its own Backend (the per-instance-group ObjectStore
+// field), in which case that wins.
+func resolveResourceStoreBackend(stateStore string, override *kops.ObjectStoreSpec) (ResourceStoreBackend, error) {
+	if override != nil && override.Backend != "" {
+		return ResourceStoreBackend(override.Backend), nil
+	}
+
+	u, err := url.Parse(stateStore)
+	if err != nil {
+		return "", fmt.Errorf("error parsing state store URL %q: %v", stateStore, err)
+	}
+	return resourceStoreBackendForScheme(u.Scheme), nil
+}
+
+// ResourceStoreEnv emits the shell snippet that configures nodeup/kubelet's
+// credentials and, where applicable, CA bundle for the object store backing
+// the kops state store. The backend is selected from the state store URL
+// scheme (s3://, gs://, swift://, oss://), with override taking precedence
+// when the instance group sets its own ObjectStore. Each backend's
+// credentials are taken from override's fields first and fall back to the
+// kops-CLI process's own environment, so two instance groups with different
+// ObjectStore overrides get their own credentials rather than identical,
+// globally-sourced ones.
+func ResourceStoreEnv(stateStore string, override *kops.ObjectStoreSpec) (string, error) {
+	backend, err := resolveResourceStoreBackend(stateStore, override)
+	if err != nil {
+		return "", err
+	}
+
+	switch backend {
+	case ResourceStoreBackendNone:
+		return "", nil
+	case ResourceStoreBackendS3:
+		return s3Env(override), nil
+	case ResourceStoreBackendGCS:
+		return gcsEnv(override), nil
+	case ResourceStoreBackendSwift:
+		return swiftEnv(override), nil
+	case ResourceStoreBackendS3Compatible:
+		return s3CompatibleEnv(override), nil
+	default:
+		return "", fmt.Errorf("unsupported object store backend %q", backend)
+	}
+}
+
+func caBundleSnippet(path, override string) string {
+	if override == "" {
+		return ""
+	}
+	return fmt.Sprintf("cat > %s << __CA_BUNDLE\n%s\n__CA_BUNDLE\n", path, override)
+}
+
+// valueOrEnv returns override when the instance group set it, otherwise
+// falls back to the kops-CLI process's own environment variable envVar.
+func valueOrEnv(override, envVar string) string {
+	if override != "" {
+		return override
+	}
+	return os.Getenv(envVar)
+}
+
+// s3Env preserves the original S3Env behavior: credentials for a
+// user-defined S3 endpoint, read from the process environment unless
+// override supplies its own.
+func s3Env(override *kops.ObjectStoreSpec) string {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	region := os.Getenv("S3_REGION")
+	accessKeyID := os.Getenv("S3_ACCESS_KEY_ID")
+	secretAccessKey := os.Getenv("S3_SECRET_ACCESS_KEY")
+	if override != nil {
+		endpoint = valueOrEnv(override.Endpoint, "S3_ENDPOINT")
+		region = valueOrEnv(override.Region, "S3_REGION")
+		accessKeyID = valueOrEnv(override.AccessKeyID, "S3_ACCESS_KEY_ID")
+		secretAccessKey = valueOrEnv(override.SecretAccessKey, "S3_SECRET_ACCESS_KEY")
+	}
+	if endpoint == "" {
+		return ""
+	}
+	env := fmt.Sprintf("export S3_ENDPOINT=%s\nexport S3_REGION=%s\nexport S3_ACCESS_KEY_ID=%s\nexport S3_SECRET_ACCESS_KEY=%s\n",
+		endpoint, region, accessKeyID, secretAccessKey)
+	if override != nil {
+		env += caBundleSnippet("/etc/ssl/certs/s3-ca.pem", override.CABundle)
+	}
+	return env
+}
+
+// s3CompatibleEnv covers MinIO/Ceph RGW/Uyuni-style local registries: same
+// shape as s3Env, but nodeup must also be told to force path-style bucket
+// addressing since these endpoints rarely support virtual-hosted buckets.
+func s3CompatibleEnv(override *kops.ObjectStoreSpec) string {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	region := os.Getenv("S3_REGION")
+	accessKeyID := os.Getenv("S3_ACCESS_KEY_ID")
+	secretAccessKey := os.Getenv("S3_SECRET_ACCESS_KEY")
+	if override != nil {
+		endpoint = valueOrEnv(override.Endpoint, "S3_ENDPOINT")
+		region = valueOrEnv(override.Region, "S3_REGION")
+		accessKeyID = valueOrEnv(override.AccessKeyID, "S3_ACCESS_KEY_ID")
+		secretAccessKey = valueOrEnv(override.SecretAccessKey, "S3_SECRET_ACCESS_KEY")
+	}
+	if endpoint == "" {
+		return ""
+	}
+	env := fmt.Sprintf("export S3_ENDPOINT=%s\nexport S3_REGION=%s\nexport S3_ACCESS_KEY_ID=%s\nexport S3_SECRET_ACCESS_KEY=%s\nexport S3_FORCE_PATH_STYLE=true\n",
+		endpoint, region, accessKeyID, secretAccessKey)
+	if override != nil {
+		env += caBundleSnippet("/etc/ssl/certs/s3-ca.pem", override.CABundle)
+	}
+	return env
+}
+
+func gcsEnv(override *kops.ObjectStoreSpec) string {
+	projectID := os.Getenv("GCS_PROJECT_ID")
+	credentials := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if override != nil {
+		projectID = valueOrEnv(override.Project, "GCS_PROJECT_ID")
+		credentials = valueOrEnv(override.CredentialsFile, "GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if projectID == "" {
+		return ""
+	}
+	env := fmt.Sprintf("export GCS_PROJECT_ID=%s\nexport GOOGLE_APPLICATION_CREDENTIALS=%s\n",
+		projectID, credentials)
+	if override != nil {
+		env += caBundleSnippet("/etc/ssl/certs/gcs-ca.pem", override.CABundle)
+	}
+	return env
+}
+
+func swiftEnv(override *kops.ObjectStoreSpec) string {
+	authURL := os.Getenv("OS_AUTH_URL")
+	username := os.Getenv("OS_USERNAME")
+	password := os.Getenv("OS_PASSWORD")
+	tenantName := os.Getenv("OS_TENANT_NAME")
+	regionName := os.Getenv("OS_REGION_NAME")
+	if override != nil {
+		authURL = valueOrEnv(override.AuthURL, "OS_AUTH_URL")
+		username = valueOrEnv(override.Username, "OS_USERNAME")
+		password = valueOrEnv(override.Password, "OS_PASSWORD")
+		tenantName = valueOrEnv(override.TenantName, "OS_TENANT_NAME")
+		regionName = valueOrEnv(override.RegionName, "OS_REGION_NAME")
+	}
+	if authURL == "" {
+		return ""
+	}
+	env := fmt.Sprintf("export OS_AUTH_URL=%s\nexport OS_USERNAME=%s\nexport OS_PASSWORD=%s\nexport OS_TENANT_NAME=%s\nexport OS_REGION_NAME=%s\n",
+		authURL, username, password, tenantName, regionName)
+	if override != nil {
+		env += caBundleSnippet("/etc/ssl/certs/swift-ca.pem", override.CABundle)
+	}
+	return env
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package model
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"k8s.io/kops/pkg/apis/kops"
+)
+
+// clearObjectStoreEnv unsets every env var the backend env builders read,
+// so tests don't pick up values leaked from the developer's shell.
+func clearObjectStoreEnv(t *testing.T) {
+	t.Helper()
+	vars := []string{
+		"S3_ENDPOINT", "S3_REGION", "S3_ACCESS_KEY_ID", "S3_SECRET_ACCESS_KEY",
+		"GCS_PROJECT_ID", "GOOGLE_APPLICATION_CREDENTIALS",
+		"OS_AUTH_URL", "OS_USERNAME", "OS_PASSWORD", "OS_TENANT_NAME", "OS_REGION_NAME",
+	}
+	saved := make(map[string]string, len(vars))
+	for _, v := range vars {
+		saved[v] = os.Getenv(v)
+		os.Unsetenv(v)
+	}
+	t.Cleanup(func() {
+		for v, val := range saved {
+			os.Setenv(v, val)
+		}
+	})
+}
+
+func TestResourceStoreEnv_UnknownScheme(t *testing.T) {
+	clearObjectStoreEnv(t)
+
+	for _, stateStore := range []string{"file:///var/lib/kops", "memfs://tests"} {
+		env, err := ResourceStoreEnv(stateStore, nil)
+		if err != nil {
+			t.Errorf("ResourceStoreEnv(%q) returned error: %v", stateStore, err)
+		}
+		if env != "" {
+			t.Errorf("ResourceStoreEnv(%q) = %q, want empty", stateStore, env)
+		}
+	}
+}
+
+func TestResourceStoreEnv_S3FromProcessEnv(t *testing.T) {
+	clearObjectStoreEnv(t)
+	os.Setenv("S3_ENDPOINT", "s3.example.com")
+	os.Setenv("S3_REGION", "us-east-1")
+	os.Setenv("S3_ACCESS_KEY_ID", "env-key")
+	os.Setenv("S3_SECRET_ACCESS_KEY", "env-secret")
+
+	env, err := ResourceStoreEnv("s3://my-state-store", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"S3_ENDPOINT=s3.example.com", "S3_ACCESS_KEY_ID=env-key", "S3_SECRET_ACCESS_KEY=env-secret"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("ResourceStoreEnv() = %q, want it to contain %q", env, want)
+		}
+	}
+}
+
+func TestResourceStoreEnv_S3OverridePerInstanceGroup(t *testing.T) {
+	clearObjectStoreEnv(t)
+	os.Setenv("S3_ENDPOINT", "global-s3.example.com")
+	os.Setenv("S3_ACCESS_KEY_ID", "global-key")
+	os.Setenv("S3_SECRET_ACCESS_KEY", "global-secret")
+
+	override := &kops.ObjectStoreSpec{
+		Endpoint:        "ig-s3.example.com",
+		AccessKeyID:     "ig-key",
+		SecretAccessKey: "ig-secret",
+		CABundle:        "-----BEGIN CERTIFICATE-----\nfake\n-----END CERTIFICATE-----",
+	}
+
+	env, err := ResourceStoreEnv("s3://my-state-store", override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(env, "global-s3.example.com") || strings.Contains(env, "global-key") || strings.Contains(env, "global-secret") {
+		t.Errorf("ResourceStoreEnv() leaked global credentials instead of the override: %q", env)
+	}
+	for _, want := range []string{"S3_ENDPOINT=ig-s3.example.com", "S3_ACCESS_KEY_ID=ig-key", "S3_SECRET_ACCESS_KEY=ig-secret", "/etc/ssl/certs/s3-ca.pem"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("ResourceStoreEnv() = %q, want it to contain %q", env, want)
+		}
+	}
+}
+
+func TestResourceStoreEnv_S3Compatible(t *testing.T) {
+	clearObjectStoreEnv(t)
+
+	override := &kops.ObjectStoreSpec{
+		Backend:         string(ResourceStoreBackendS3Compatible),
+		Endpoint:        "minio.internal:9000",
+		AccessKeyID:     "minio-key",
+		SecretAccessKey: "minio-secret",
+	}
+
+	env, err := ResourceStoreEnv("s3://unused", override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(env, "S3_FORCE_PATH_STYLE=true") {
+		t.Errorf("ResourceStoreEnv() = %q, want S3_FORCE_PATH_STYLE=true", env)
+	}
+}
+
+func TestResourceStoreEnv_GCSOverride(t *testing.T) {
+	clearObjectStoreEnv(t)
+
+	override := &kops.ObjectStoreSpec{
+		Project:         "ig-project",
+		CredentialsFile: "/etc/gcs/ig-creds.json",
+	}
+
+	env, err := ResourceStoreEnv("gs://my-state-store", override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"GCS_PROJECT_ID=ig-project", "GOOGLE_APPLICATION_CREDENTIALS=/etc/gcs/ig-creds.json"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("ResourceStoreEnv() = %q, want it to contain %q", env, want)
+		}
+	}
+}
+
+func TestResourceStoreEnv_SwiftOverride(t *testing.T) {
+	clearObjectStoreEnv(t)
+
+	override := &kops.ObjectStoreSpec{
+		AuthURL:    "https://swift.example.com/auth",
+		Username:   "ig-user",
+		Password:   "ig-pass",
+		TenantName: "ig-tenant",
+		RegionName: "ig-region",
+	}
+
+	env, err := ResourceStoreEnv("swift://my-state-store", override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"OS_AUTH_URL=https://swift.example.com/auth", "OS_USERNAME=ig-user", "OS_PASSWORD=ig-pass", "OS_TENANT_NAME=ig-tenant", "OS_REGION_NAME=ig-region"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("ResourceStoreEnv() = %q, want it to contain %q", env, want)
+		}
+	}
+}
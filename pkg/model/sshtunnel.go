@@ -0,0 +1,129 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"k8s.io/kops/pkg/apis/kops"
+)
+
+// sshProxyDir is where apiserver expects to find its SSH tunnel credentials,
+// mirroring the layout used by the upstream kube-apiserver SSH-tunnel option.
+const sshProxyDir = "/srv/sshproxy"
+
+// AuthorizedKeyForSSHTunnel returns the public key that should be installed
+// into every node's authorized_keys so the master can dial in over SSH to
+// reach kubelet/pod endpoints. The public key is read from AuthorizedKeyPath;
+// the private half lives only on the master (see PrivateKeyForSSHTunnel).
+func AuthorizedKeyForSSHTunnel(spec *kops.SSHTunnelSpec) (string, error) {
+	if spec.AuthorizedKeyPath == "" {
+		return "", fmt.Errorf("AuthorizedKeyPath must be set when SSHTunnel is enabled")
+	}
+
+	b, err := ioutil.ReadFile(spec.AuthorizedKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading SSH tunnel public key %q: %v", spec.AuthorizedKeyPath, err)
+	}
+
+	return string(b), nil
+}
+
+// SecretStore is the subset of kops's secret store that PrivateKeyForSSHTunnel
+// needs to fetch the tunnel private key by name. kops's keystore/secret store
+// implementations (fi.Keystore) satisfy this.
+type SecretStore interface {
+	FindSecret(name string) ([]byte, error)
+}
+
+// PrivateKeyForSSHTunnel returns the private key that must be materialized
+// on the master at SSHProxyBuilder.Dir() so apiserver's --ssh-keyfile can
+// use it to dial nodes. The public half is installed on every node by
+// AuthorizedKeyForSSHTunnel. Unlike the public key, the private key is
+// sensitive, so it's fetched from secretStore by name (PrivateKeySecret)
+// rather than read from a local file, keeping it out of cluster config and
+// out of version control.
+func PrivateKeyForSSHTunnel(secretStore SecretStore, spec *kops.SSHTunnelSpec) (string, error) {
+	if spec.PrivateKeySecret == "" {
+		return "", fmt.Errorf("PrivateKeySecret must be set when SSHTunnel is enabled")
+	}
+
+	b, err := secretStore.FindSecret(spec.PrivateKeySecret)
+	if err != nil {
+		return "", fmt.Errorf("error reading SSH tunnel private key secret %q: %v", spec.PrivateKeySecret, err)
+	}
+	if b == nil {
+		return "", fmt.Errorf("SSH tunnel private key secret %q not found", spec.PrivateKeySecret)
+	}
+
+	return string(b), nil
+}
+
+// SSHProxyBuilder materializes the master-side /srv/sshproxy directory and
+// the apiserver flags that point at it, analogous to the kube-apiserver
+// --ssh-user/--ssh-keyfile SSH-tunnel-to-/proxy option.
+type SSHProxyBuilder struct {
+	SSHTunnel   *kops.SSHTunnelSpec
+	SecretStore SecretStore
+}
+
+// Dir returns the directory on the master where the tunnel private key is
+// materialized.
+func (b *SSHProxyBuilder) Dir() string {
+	return sshProxyDir
+}
+
+// MaterializeEnv returns the shell snippet that writes the tunnel private
+// key into Dir(), with the permissions --ssh-keyfile requires. It returns
+// "" when SSHTunnel is unset or disabled.
+func (b *SSHProxyBuilder) MaterializeEnv() (string, error) {
+	if b.SSHTunnel == nil || !b.SSHTunnel.Enabled {
+		return "", nil
+	}
+
+	privateKey, err := PrivateKeyForSSHTunnel(b.SecretStore, b.SSHTunnel)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(
+		"mkdir -p %s\n"+
+			"cat > %s/id_rsa << __SSH_TUNNEL_PRIVATE_KEY\n"+
+			"%s\n"+
+			"__SSH_TUNNEL_PRIVATE_KEY\n"+
+			"chmod 0600 %s/id_rsa\n",
+		sshProxyDir, sshProxyDir, privateKey, sshProxyDir), nil
+}
+
+// APIServerFlags returns the --ssh-user/--ssh-keyfile flags apiserver needs
+// in order to dial nodes over the SSH tunnel instead of a direct route.
+func (b *SSHProxyBuilder) APIServerFlags() (map[string]string, error) {
+	if b.SSHTunnel == nil || !b.SSHTunnel.Enabled {
+		return nil, nil
+	}
+
+	user := b.SSHTunnel.User
+	if user == "" {
+		user = "sshproxy"
+	}
+
+	return map[string]string{
+		"ssh-user":    user,
+		"ssh-keyfile": sshProxyDir + "/id_rsa",
+	}, nil
+}
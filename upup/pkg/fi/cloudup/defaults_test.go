@@ -75,3 +75,62 @@ func TestPopulateClusterSpec_Proxy(t *testing.T) {
 	}
 
 }
+
+func TestPopulateClusterSpec_ProxyWithCredentials(t *testing.T) {
+	c := buildMinimalCluster()
+
+	c.Spec.CloudProvider = "aws"
+	c.Spec.NonMasqueradeCIDR = "100.64.0.1/10"
+	c.Spec.EgressProxy = &kops.EgressProxySpec{
+		HTTPProxy: kops.HTTPProxySpec{
+			Host:     "proxy.example.com",
+			Port:     3128,
+			User:     "proxy-user",
+			Password: "s3cr3t@pass",
+		},
+	}
+
+	var err error
+	c.Spec.EgressProxy, err = assignProxy(c)
+	if err != nil {
+		t.Fatalf("unable to assign proxy, %v", err)
+	}
+
+	if c.Spec.EgressProxy.HTTPProxy.User != "proxy-user" {
+		t.Fatalf("expected HTTPProxy.User to be preserved, got %q", c.Spec.EgressProxy.HTTPProxy.User)
+	}
+	if c.Spec.EgressProxy.HTTPProxy.Password != "s3cr3t@pass" {
+		t.Fatalf("expected HTTPProxy.Password to be preserved, got %q", c.Spec.EgressProxy.HTTPProxy.Password)
+	}
+}
+
+func TestPopulateClusterSpec_SplitHTTPSProxy(t *testing.T) {
+	c := buildMinimalCluster()
+
+	c.Spec.CloudProvider = "aws"
+	c.Spec.NonMasqueradeCIDR = "100.64.0.1/10"
+	c.Spec.EgressProxy = &kops.EgressProxySpec{
+		HTTPProxy: kops.HTTPProxySpec{
+			Host: "http-proxy.example.com",
+			Port: 3128,
+		},
+		HTTPSProxy: kops.HTTPProxySpec{
+			Host: "https-proxy.example.com",
+			Port: 3129,
+			User: "https-user",
+		},
+	}
+
+	var err error
+	c.Spec.EgressProxy, err = assignProxy(c)
+	if err != nil {
+		t.Fatalf("unable to assign proxy, %v", err)
+	}
+
+	if c.Spec.EgressProxy.HTTPProxy.Host == c.Spec.EgressProxy.HTTPSProxy.Host {
+		t.Fatalf("expected HTTPProxy and HTTPSProxy to remain independently configurable")
+	}
+	if c.Spec.EgressProxy.HTTPSProxy.User != "https-user" {
+		t.Fatalf("expected HTTPSProxy.User to be preserved, got %q", c.Spec.EgressProxy.HTTPSProxy.User)
+	}
+}